@@ -5,45 +5,88 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 
 	errorsutil "github.com/pkg/errors"
 	"github.com/rancher/kontainer-engine/service"
 	"github.com/rancher/kontainer-engine/types"
+	"github.com/rancher/norman/condition"
+	"github.com/rancher/rancher/pkg/clustermanager"
 	"github.com/rancher/rancher/pkg/controllers/management/clusterprovisioner"
 	"github.com/rancher/rke/cloudprovider/aws"
 	"github.com/rancher/rke/cloudprovider/azure"
+	"github.com/rancher/rke/cloudprovider/gce"
+	"github.com/rancher/rke/cloudprovider/openstack"
+	"github.com/rancher/rke/cloudprovider/vsphere"
 	v1 "github.com/rancher/types/apis/core/v1"
 	v3 "github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
 const (
 	GoogleCloudLoadBalancer = "GCLB"
 	ElasticLoadBalancer     = "ELB"
 	AzureL4LB               = "Azure L4 LB"
+	OctaviaLoadBalancer     = "Octavia"
 	NginxIngressProvider    = "Nginx"
+	GCEIngressProvider      = "GCE"
+	ALBIngressProvider      = "ALB"
 	DefaultNodePortRange    = "30000-32767"
+
+	AWSInternalLBAnnotation   = "service.beta.kubernetes.io/aws-load-balancer-internal"
+	AzureInternalLBAnnotation = "service.beta.kubernetes.io/azure-load-balancer-internal"
+	GCEInternalLBAnnotation   = "cloud.google.com/load-balancer-type"
+
+	CapabilitiesUpdatedEvent = "CapabilitiesUpdated"
+	// retryQPS/retryBurst bound, per cluster, how often a failing capability lookup may write the
+	// CapabilitiesReady=False condition and return its error (see retryableError)
+	retryQPS   = 0.2
+	retryBurst = 3
 )
 
+// ClusterConditionCapabilitiesReady is set to False when capsSync fails to determine a cluster's
+// capabilities, so operators can see why the advertised feature set is stale instead of just a log line.
+// The False write is rate-limited per cluster; a failure that finds no token is only logged at debug level.
+var ClusterConditionCapabilitiesReady = condition.Cond("CapabilitiesReady")
+
 type controller struct {
 	clusterClient         v3.ClusterInterface
 	nodeLister            v3.NodeLister
 	kontainerDriverLister v3.KontainerDriverLister
 	namespaces            v1.NamespaceInterface
 	coreV1                v1.Interface
+	eventRecorder         record.EventRecorder
+	clusterManager        *clustermanager.Manager
+
+	retryLimitersLock sync.Mutex
+	retryLimiters     map[string]flowcontrol.RateLimiter
 }
 
-func Register(ctx context.Context, management *config.ManagementContext) {
+func Register(ctx context.Context, management *config.ManagementContext, clusterManager *clustermanager.Manager) {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(logrus.Debugf)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: management.K8sClient.CoreV1().Events(""),
+	})
+
 	c := controller{
 		clusterClient:         management.Management.Clusters(""),
 		nodeLister:            management.Management.Nodes("").Controller().Lister(),
 		kontainerDriverLister: management.Management.KontainerDrivers("").Controller().Lister(),
 		namespaces:            management.Core.Namespaces(""),
 		coreV1:                management.Core,
+		eventRecorder:         eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cluster-capabilities-controller"}),
+		clusterManager:        clusterManager,
+		retryLimiters:         map[string]flowcontrol.RateLimiter{},
 	}
 
 	c.clusterClient.AddHandler(ctx, "clusterCreateUpdate", c.capsSync)
@@ -67,7 +110,7 @@ func (c *controller) capsSync(key string, cluster *v3.Cluster) (runtime.Object,
 			supportsTaints := true
 			capabilities.TaintSupport = &supportsTaints
 		}
-		if capabilities, err = c.RKECapabilities(capabilities, *cluster.Spec.RancherKubernetesEngineConfig, cluster.Name); err != nil {
+		if capabilities, err = c.RKECapabilities(capabilities, *cluster.Spec.RancherKubernetesEngineConfig, cluster); err != nil {
 			return nil, err
 		}
 	} else if cluster.Spec.GenericEngineConfig != nil {
@@ -81,7 +124,7 @@ func (c *controller) capsSync(key string, cluster *v3.Cluster) (runtime.Object,
 		kontainerDriver, err := c.kontainerDriverLister.Get("", driverName)
 		if err != nil {
 			if !errors.IsNotFound(err) {
-				return nil, errorsutil.WithMessage(err, fmt.Sprintf("error getting kontainer driver: %v", driverName))
+				return nil, c.retryableError(cluster, errorsutil.WithMessage(err, fmt.Sprintf("error getting kontainer driver: %v", driverName)))
 			}
 			//do not return not found errors since the driver may have been deleted
 			return nil, nil
@@ -93,7 +136,7 @@ func (c *controller) capsSync(key string, cluster *v3.Cluster) (runtime.Object,
 		k8sCapabilities, err := driver.GetK8sCapabilities(context.Background(), kontainerDriver.Name, kontainerDriver,
 			cluster.Spec)
 		if err != nil {
-			return nil, fmt.Errorf("error getting k8s capabilities: %v", err)
+			return nil, c.retryableError(cluster, fmt.Errorf("error getting k8s capabilities: %v", err))
 		}
 
 		capabilities = toCapabilities(k8sCapabilities)
@@ -103,7 +146,21 @@ func (c *controller) capsSync(key string, cluster *v3.Cluster) (runtime.Object,
 
 	if !reflect.DeepEqual(capabilities, cluster.Status.Capabilities) {
 		toUpdateCluster := cluster.DeepCopy()
+		diff := diffCapabilities(cluster.Status.Capabilities, capabilities)
 		toUpdateCluster.Status.Capabilities = capabilities
+		ClusterConditionCapabilitiesReady.True(toUpdateCluster)
+		updated, err := c.clusterClient.Update(toUpdateCluster)
+		if err != nil {
+			return nil, err
+		}
+		if diff != "" {
+			c.eventRecorder.Event(updated, corev1.EventTypeNormal, CapabilitiesUpdatedEvent, diff)
+		}
+	} else if !ClusterConditionCapabilitiesReady.IsTrue(cluster) {
+		// capabilities are unchanged, but the condition is not True (never set, or left False by a prior sync
+		// e.g. after a transient driver error that has since cleared) - set it now so it reflects current reality
+		toUpdateCluster := cluster.DeepCopy()
+		ClusterConditionCapabilitiesReady.True(toUpdateCluster)
 		if _, err := c.clusterClient.Update(toUpdateCluster); err != nil {
 			return nil, err
 		}
@@ -112,12 +169,148 @@ func (c *controller) capsSync(key string, cluster *v3.Cluster) (runtime.Object,
 	return nil, nil
 }
 
-func (c *controller) RKECapabilities(capabilities v3.Capabilities, rkeConfig v3.RancherKubernetesEngineConfig, clusterName string) (v3.Capabilities, error) {
+// retryableError is only allowed to act (write the CapabilitiesReady=False condition and hand the error back
+// to the reconciler) when the token-bucket limiter has a token available. A persistently failing driver gets
+// reconciled again and again via the informer regardless, so gating only the returned error would still let
+// it hammer the apiserver with a status write every time; gating the write itself is what actually bounds it.
+func (c *controller) retryableError(cluster *v3.Cluster, err error) error {
+	if !c.retryLimiterFor(cluster.Name).TryAccept() {
+		logrus.Debugf("cluster %v: capability sync error rate-limited, deferring retry: %v", cluster.Name, err)
+		return nil
+	}
+
+	toUpdateCluster := cluster.DeepCopy()
+	ClusterConditionCapabilitiesReady.False(toUpdateCluster)
+	ClusterConditionCapabilitiesReady.Message(toUpdateCluster, err.Error())
+	if _, updateErr := c.clusterClient.Update(toUpdateCluster); updateErr != nil {
+		logrus.Warnf("cluster %v: failed to set CapabilitiesReady condition: %v", cluster.Name, updateErr)
+	}
+
+	return err
+}
+
+// retryLimiterFor returns the token-bucket limiter for clusterName, creating one on first use. Limiters are
+// kept per-cluster so a permanently broken driver on one cluster can't exhaust a shared budget and starve
+// retries for unrelated clusters' unrelated transient errors.
+func (c *controller) retryLimiterFor(clusterName string) flowcontrol.RateLimiter {
+	c.retryLimitersLock.Lock()
+	defer c.retryLimitersLock.Unlock()
+
+	limiter, ok := c.retryLimiters[clusterName]
+	if !ok {
+		limiter = flowcontrol.NewTokenBucketRateLimiter(retryQPS, retryBurst)
+		c.retryLimiters[clusterName] = limiter
+	}
+	return limiter
+}
+
+// diffCapabilities summarizes the user-visible changes between two Capabilities so the CapabilitiesUpdated
+// event tells an operator what changed without requiring them to diff the full struct themselves.
+func diffCapabilities(old, updated v3.Capabilities) string {
+	var changes []string
+
+	oldProviders := ingressProviders(old.IngressCapabilities)
+	updatedProviders := ingressProviders(updated.IngressCapabilities)
+	if added := setDiff(updatedProviders, oldProviders); len(added) > 0 {
+		changes = append(changes, fmt.Sprintf("ingress providers added: %v", added))
+	}
+	if removed := setDiff(oldProviders, updatedProviders); len(removed) > 0 {
+		changes = append(changes, fmt.Sprintf("ingress providers removed: %v", removed))
+	}
+
+	if old.NodePortRange != updated.NodePortRange {
+		changes = append(changes, fmt.Sprintf("NodePortRange changed from %q to %q", old.NodePortRange, updated.NodePortRange))
+	}
+
+	if old.LoadBalancerCapabilities.Provider != updated.LoadBalancerCapabilities.Provider {
+		changes = append(changes, fmt.Sprintf("load balancer provider changed from %q to %q",
+			old.LoadBalancerCapabilities.Provider, updated.LoadBalancerCapabilities.Provider))
+	}
+
+	if old.InternalLoadBalancerCapabilities.Provider != updated.InternalLoadBalancerCapabilities.Provider {
+		changes = append(changes, fmt.Sprintf("internal load balancer provider changed from %q to %q",
+			old.InternalLoadBalancerCapabilities.Provider, updated.InternalLoadBalancerCapabilities.Provider))
+	}
+
+	oldByProvider := ingressCapabilitiesByProvider(old.IngressCapabilities)
+	for _, uc := range updated.IngressCapabilities {
+		oc, ok := oldByProvider[uc.IngressProvider]
+		if ok && !ingressCapabilitiesEqual(oc, uc) {
+			changes = append(changes, fmt.Sprintf("ingress capabilities changed for %q", uc.IngressProvider))
+		}
+	}
+
+	return strings.Join(changes, "; ")
+}
+
+func ingressProviders(caps []v3.IngressCapabilities) []string {
+	var providers []string
+	for _, c := range caps {
+		providers = append(providers, c.IngressProvider)
+	}
+	return providers
+}
+
+func ingressCapabilitiesByProvider(caps []v3.IngressCapabilities) map[string]v3.IngressCapabilities {
+	byProvider := map[string]v3.IngressCapabilities{}
+	for _, c := range caps {
+		byProvider[c.IngressProvider] = c
+	}
+	return byProvider
+}
+
+// ingressCapabilitiesEqual compares the feature flags two IngressCapabilities entries advertise, so an
+// existing controller whose flags change (e.g. an ingressCapabilityRegistry update rolls out) is detected
+// even though its IngressProvider name - the only thing setDiff compares - stays the same.
+func ingressCapabilitiesEqual(a, b v3.IngressCapabilities) bool {
+	return boolPtrEqual(a.CustomDefaultBackend, b.CustomDefaultBackend) &&
+		boolPtrEqual(a.SSLPassthroughSupported, b.SSLPassthroughSupported) &&
+		boolPtrEqual(a.TCPServicesSupported, b.TCPServicesSupported) &&
+		boolPtrEqual(a.UDPServicesSupported, b.UDPServicesSupported) &&
+		boolPtrEqual(a.PerHostTLSSupported, b.PerHostTLSSupported) &&
+		boolPtrEqual(a.CanaryAnnotationsSupported, b.CanaryAnnotationsSupported)
+}
+
+func boolPtrEqual(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// setDiff returns the elements of a that are not present in b.
+func setDiff(a, b []string) []string {
+	inB := map[string]bool{}
+	for _, v := range b {
+		inB[v] = true
+	}
+	var diff []string
+	for _, v := range a {
+		if !inB[v] {
+			diff = append(diff, v)
+		}
+	}
+	return diff
+}
+
+func (c *controller) RKECapabilities(capabilities v3.Capabilities, rkeConfig v3.RancherKubernetesEngineConfig, cluster *v3.Cluster) (v3.Capabilities, error) {
+	clusterName := cluster.Name
 	switch rkeConfig.CloudProvider.Name {
 	case aws.AWSCloudProviderName:
 		capabilities.LoadBalancerCapabilities = c.L4Capability(true, ElasticLoadBalancer, []string{"TCP"}, true)
+		capabilities.InternalLoadBalancerCapabilities = c.L4InternalCapability(true, ElasticLoadBalancer, []string{"TCP"}, true, AWSInternalLBAnnotation)
 	case azure.AzureCloudProviderName:
 		capabilities.LoadBalancerCapabilities = c.L4Capability(true, AzureL4LB, []string{"TCP", "UDP"}, true)
+		capabilities.InternalLoadBalancerCapabilities = c.L4InternalCapability(true, AzureL4LB, []string{"TCP", "UDP"}, true, AzureInternalLBAnnotation)
+	case gce.GCECloudProviderName:
+		capabilities.LoadBalancerCapabilities = c.L4Capability(true, GoogleCloudLoadBalancer, []string{"TCP", "UDP"}, true)
+		capabilities.InternalLoadBalancerCapabilities = c.L4InternalCapability(true, GoogleCloudLoadBalancer, []string{"TCP", "UDP"}, true, GCEInternalLBAnnotation)
+	case vsphere.VsphereCloudProviderName:
+		// vSphere does not provision an L4 load balancer, so report it as unsupported and let the UI hide the option
+		capabilities.LoadBalancerCapabilities = c.L4Capability(false, "", nil, false)
+		capabilities.InternalLoadBalancerCapabilities = c.L4InternalCapability(false, "", nil, false, "")
+	case openstack.OpenstackCloudProviderName:
+		capabilities.LoadBalancerCapabilities = c.L4Capability(true, OctaviaLoadBalancer, []string{"TCP", "UDP"}, true)
 	}
 	// only if not custom, non custom clusters have nodepools set
 	nodes, err := c.nodeLister.List(clusterName, labels.Everything())
@@ -133,6 +326,13 @@ func (c *controller) RKECapabilities(capabilities v3.Capabilities, rkeConfig v3.
 
 	ingressController := c.IngressCapability(true, rkeConfig.Ingress.Provider)
 	capabilities.IngressCapabilities = []v3.IngressCapabilities{ingressController}
+
+	additionalIngressCapabilities, err := c.additionalIngressCapabilities(cluster, rkeConfig.Ingress.Provider)
+	if err != nil {
+		return capabilities, err
+	}
+	capabilities.IngressCapabilities = append(capabilities.IngressCapabilities, additionalIngressCapabilities...)
+
 	if rkeConfig.Services.KubeAPI.ServiceNodePortRange != "" {
 		capabilities.NodePortRange = rkeConfig.Services.KubeAPI.ServiceNodePortRange
 	} else if rkeConfig.Services.KubeAPI.ExtraArgs["service-node-port-range"] != "" {
@@ -152,14 +352,140 @@ func (c *controller) L4Capability(enabled bool, providerName string, protocols [
 	return l4lb
 }
 
+func (c *controller) L4InternalCapability(enabled bool, providerName string, protocols []string, healthCheck bool, subnetAnnotation string) v3.InternalLoadBalancerCapabilities {
+	internalL4LB := v3.InternalLoadBalancerCapabilities{
+		Enabled:              &enabled,
+		Provider:             providerName,
+		ProtocolsSupported:   protocols,
+		HealthCheckSupported: healthCheck,
+		SubnetAnnotation:     subnetAnnotation,
+	}
+	return internalL4LB
+}
+
+// additionalIngressCapabilities lists any IngressClass resources configured in the downstream cluster beyond
+// the built-in rkeConfig.Ingress.Provider (already reported by the caller), so a cluster running e.g. nginx
+// for HTTP plus Kong for API routing also reports Kong. Entries are one per IngressClass, named after the
+// class, and a class whose name matches the built-in provider is skipped; two classes served by the same
+// controller each get their own entry. Failures
+// talking to the downstream cluster go through retryableError, the same CapabilitiesReady + rate-limited
+// retry path used for kontainer-driver lookups, rather than thrashing the reconciler or going unnoticed.
+func (c *controller) additionalIngressCapabilities(cluster *v3.Cluster, builtinIngressProvider string) ([]v3.IngressCapabilities, error) {
+	if c.clusterManager == nil {
+		return nil, nil
+	}
+
+	userContext, err := c.clusterManager.UserContext(cluster.Name)
+	if err != nil {
+		return nil, c.retryableError(cluster, fmt.Errorf("error getting user context to discover additional ingress controllers: %v", err))
+	}
+
+	classes, err := userContext.Networking.IngressClasses("").Controller().Lister().List("", labels.Everything())
+	if err != nil {
+		return nil, c.retryableError(cluster, fmt.Errorf("error listing IngressClasses: %v", err))
+	}
+
+	var additional []v3.IngressCapabilities
+	for _, class := range classes {
+		if strings.EqualFold(class.Name, builtinIngressProvider) {
+			// already reported above as the built-in rkeConfig.Ingress.Provider entry
+			continue
+		}
+		additional = append(additional, c.IngressCapability(true, class.Name))
+	}
+	return additional, nil
+}
+
+// ingressCapabilityProfile captures the feature flags a given ingress controller advertises. New controllers
+// are onboarded by adding an entry to ingressCapabilityRegistry, not by growing a switch statement.
+type ingressCapabilityProfile struct {
+	customDefaultBackend       *bool
+	sslPassthroughSupported    *bool
+	tcpServicesSupported       *bool
+	udpServicesSupported       *bool
+	perHostTLSSupported        *bool
+	canaryAnnotationsSupported *bool
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// ingressCapabilityRegistry maps a lowercased ingress controller name to the capabilities it advertises.
+// A provider with no entry (e.g. an operator-authored IngressClass) falls back to an empty profile.
+var ingressCapabilityRegistry = map[string]ingressCapabilityProfile{
+	strings.ToLower(NginxIngressProvider): {
+		customDefaultBackend:       boolPtr(false),
+		sslPassthroughSupported:    boolPtr(true),
+		tcpServicesSupported:       boolPtr(true),
+		udpServicesSupported:       boolPtr(true),
+		perHostTLSSupported:        boolPtr(true),
+		canaryAnnotationsSupported: boolPtr(true),
+	},
+	strings.ToLower(GCEIngressProvider): {
+		sslPassthroughSupported:    boolPtr(false),
+		tcpServicesSupported:       boolPtr(false),
+		udpServicesSupported:       boolPtr(false),
+		perHostTLSSupported:        boolPtr(true),
+		canaryAnnotationsSupported: boolPtr(false),
+	},
+	strings.ToLower(ALBIngressProvider): {
+		sslPassthroughSupported:    boolPtr(false),
+		tcpServicesSupported:       boolPtr(false),
+		udpServicesSupported:       boolPtr(false),
+		perHostTLSSupported:        boolPtr(true),
+		canaryAnnotationsSupported: boolPtr(false),
+	},
+	"kong": {
+		customDefaultBackend:       boolPtr(false),
+		sslPassthroughSupported:    boolPtr(true),
+		tcpServicesSupported:       boolPtr(true),
+		udpServicesSupported:       boolPtr(true),
+		perHostTLSSupported:        boolPtr(true),
+		canaryAnnotationsSupported: boolPtr(true),
+	},
+	"traefik": {
+		customDefaultBackend:       boolPtr(false),
+		sslPassthroughSupported:    boolPtr(true),
+		tcpServicesSupported:       boolPtr(true),
+		udpServicesSupported:       boolPtr(true),
+		perHostTLSSupported:        boolPtr(true),
+		canaryAnnotationsSupported: boolPtr(true),
+	},
+	"haproxy": {
+		customDefaultBackend:       boolPtr(false),
+		sslPassthroughSupported:    boolPtr(true),
+		tcpServicesSupported:       boolPtr(true),
+		udpServicesSupported:       boolPtr(true),
+		perHostTLSSupported:        boolPtr(true),
+		canaryAnnotationsSupported: boolPtr(false),
+	},
+	"contour": {
+		customDefaultBackend:       boolPtr(false),
+		sslPassthroughSupported:    boolPtr(true),
+		tcpServicesSupported:       boolPtr(false),
+		udpServicesSupported:       boolPtr(false),
+		perHostTLSSupported:        boolPtr(true),
+		canaryAnnotationsSupported: boolPtr(true),
+	},
+}
+
 func (c *controller) IngressCapability(httpLBEnabled bool, providerName string) v3.IngressCapabilities {
-	customDefaultBackendDisabled := false
 	ing := v3.IngressCapabilities{
 		IngressProvider: providerName,
 	}
-	if strings.EqualFold(providerName, NginxIngressProvider) {
-		ing.CustomDefaultBackend = &customDefaultBackendDisabled
+
+	profile, ok := ingressCapabilityRegistry[strings.ToLower(providerName)]
+	if !ok {
+		return ing
 	}
+
+	ing.CustomDefaultBackend = profile.customDefaultBackend
+	ing.SSLPassthroughSupported = profile.sslPassthroughSupported
+	ing.TCPServicesSupported = profile.tcpServicesSupported
+	ing.UDPServicesSupported = profile.udpServicesSupported
+	ing.PerHostTLSSupported = profile.perHostTLSSupported
+	ing.CanaryAnnotationsSupported = profile.canaryAnnotationsSupported
 	return ing
 }
 
@@ -181,6 +507,13 @@ func toCapabilities(k8sCapabilities *types.K8SCapabilities) v3.Capabilities {
 			ProtocolsSupported:   k8sCapabilities.L4LoadBalancer.ProtocolsSupported,
 			Provider:             k8sCapabilities.L4LoadBalancer.Provider,
 		},
+		InternalLoadBalancerCapabilities: v3.InternalLoadBalancerCapabilities{
+			Enabled:              &k8sCapabilities.L4InternalLoadBalancer.Enabled,
+			HealthCheckSupported: k8sCapabilities.L4InternalLoadBalancer.HealthCheckSupported,
+			ProtocolsSupported:   k8sCapabilities.L4InternalLoadBalancer.ProtocolsSupported,
+			Provider:             k8sCapabilities.L4InternalLoadBalancer.Provider,
+			SubnetAnnotation:     k8sCapabilities.L4InternalLoadBalancer.SubnetAnnotation,
+		},
 		NodePoolScalingSupported: k8sCapabilities.NodePoolScalingSupported,
 		NodePortRange:            k8sCapabilities.NodePortRange,
 	}